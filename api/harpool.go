@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// harPool rotates through request headers captured from real browser
+// sessions via HAR (HTTP Archive) exports, so outgoing requests don't all
+// carry the same static fingerprint.
+type harPool struct {
+	mu      sync.Mutex
+	entries []http.Header
+	next_   int
+}
+
+// next returns the next header set in rotation.
+func (p *harPool) next() http.Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.entries[p.next_%len(p.entries)]
+	p.next_++
+	return h
+}
+
+// harFile is the subset of the HAR 1.2 schema this shim reads.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// hopByHopHeaders are stripped from captured HAR headers because this shim
+// sets them itself, or because they describe the original connection rather
+// than anything the new request should replay. HTTP/2 pseudo-headers
+// (":authority", ":method", etc.), which Chrome's HAR export includes on
+// every request, are stripped separately since net/http rejects a ":"-prefixed
+// name as a real header field on the HTTP/1.1 requests this shim sends.
+var hopByHopHeaders = map[string]bool{
+	"content-length":  true,
+	"content-type":    true,
+	"is-demo":         true,
+	"conversation-id": true,
+	"host":            true,
+	"cookie":          true,
+}
+
+// loadHarPool reads every *.har file in dir and collects the request headers
+// from captured POST .../api/chat/message calls.
+func loadHarPool(dir string) (*harPool, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.har"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []http.Header
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var har harFile
+		if err := json.Unmarshal(data, &har); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+
+		for _, entry := range har.Log.Entries {
+			if entry.Request.Method != http.MethodPost || !strings.Contains(entry.Request.URL, "/api/chat/message") {
+				continue
+			}
+			h := http.Header{}
+			for _, header := range entry.Request.Headers {
+				if strings.HasPrefix(header.Name, ":") || hopByHopHeaders[strings.ToLower(header.Name)] {
+					continue
+				}
+				h.Add(header.Name, header.Value)
+			}
+			entries = append(entries, h)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no /api/chat/message entries found in %s", dir)
+	}
+
+	return &harPool{entries: entries}, nil
+}
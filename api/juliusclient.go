@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const defaultJuliusBaseURL = "https://playground.julius.ai"
+
+// JuliusClient owns everything needed to talk to the upstream Julius API:
+// where it lives, what HTTP client (and therefore proxy/transport) to use,
+// and which request headers to present. When JULIUS_HAR_DIR is set, it
+// rotates through headers captured from real browser sessions instead of the
+// static header template, to better survive upstream anti-bot fingerprinting.
+type JuliusClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	harPool    *harPool
+}
+
+// defaultJuliusClient is the client Handler and the temp-user-id pool use;
+// it's built once from environment configuration at startup.
+var defaultJuliusClient = newJuliusClientFromEnv()
+
+func newJuliusClientFromEnv() *JuliusClient {
+	baseURL := os.Getenv("JULIUS_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultJuliusBaseURL
+	}
+
+	c := &JuliusClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{},
+	}
+
+	if harDir := os.Getenv("JULIUS_HAR_DIR"); harDir != "" {
+		pool, err := loadHarPool(harDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "julius: failed to load HAR pool from %s: %v\n", harDir, err)
+		} else {
+			c.harPool = pool
+		}
+	}
+
+	return c
+}
+
+func (c *JuliusClient) getTempUserID() (string, error) {
+	resp, err := c.HTTPClient.Get(c.BaseURL + "/api/temp_user_id")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status     string `json:"status"`
+		TempUserID string `json:"temp_user_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.TempUserID, nil
+}
+
+var dataURIPattern = regexp.MustCompile(`^data:([^;,]+);base64,(.+)$`)
+
+// parseDataURI splits a `data:<mime>;base64,<payload>` URI into its decoded
+// bytes and MIME type.
+func parseDataURI(uri string) (mimeType string, raw []byte, err error) {
+	m := dataURIPattern.FindStringSubmatch(uri)
+	if m == nil {
+		return "", nil, fmt.Errorf("unsupported data URI format")
+	}
+	raw, err = base64.StdEncoding.DecodeString(m[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding base64 image data: %w", err)
+	}
+	return m[1], raw, nil
+}
+
+// uploadImage hands a decoded image to Julius's upload endpoint (the same
+// GCS-backed storage `"Gcs": "true"` on the chat request opts into) and
+// returns the hosted URL Julius gives back for it.
+func (c *JuliusClient) uploadImage(tempUserID string, raw []byte, mimeType string) (string, error) {
+	req, err := http.NewRequest("POST", c.BaseURL+"/api/uploads", bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	req.Header.Set("is-demo", tempUserID)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", ErrQuotaExhausted
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("julius: image upload failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding image upload response: %w", err)
+	}
+	if result.URL == "" {
+		return "", fmt.Errorf("julius: image upload response carried no url")
+	}
+	return result.URL, nil
+}
+
+// resolveImages turns a message's image references into hosted URLs Julius
+// can fetch: http(s) URLs already point somewhere Julius can reach, but
+// data: URIs have to be uploaded first since new_images expects a hosted
+// reference, not an inline blob.
+func (c *JuliusClient) resolveImages(tempUserID string, images []string) ([]string, error) {
+	if len(images) == 0 {
+		return nil, nil
+	}
+	resolved := make([]string, 0, len(images))
+	for _, img := range images {
+		if !strings.HasPrefix(img, "data:") {
+			resolved = append(resolved, img)
+			continue
+		}
+		mimeType, raw, err := parseDataURI(img)
+		if err != nil {
+			return nil, fmt.Errorf("parsing inline image: %w", err)
+		}
+		url, err := c.uploadImage(tempUserID, raw, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("uploading inline image: %w", err)
+		}
+		resolved = append(resolved, url)
+	}
+	return resolved, nil
+}
+
+// juliusImagePayload converts resolved image URLs into the shape Julius's
+// `new_images` field expects, or nil if the message carried no images.
+func juliusImagePayload(images []string) interface{} {
+	if len(images) == 0 {
+		return nil
+	}
+	payload := make([]map[string]interface{}, len(images))
+	for i, url := range images {
+		payload[i] = map[string]interface{}{"url": url}
+	}
+	return payload
+}
+
+// buildRequest assembles the POST to /api/chat/message. Headers come from a
+// rotated HAR capture when a pool is configured, falling back to the static
+// template this shim has always sent; either way is-demo and conversation-id
+// are set last so they always reflect this specific call.
+func (c *JuliusClient) buildRequest(tempUserID, conversationID string, content Content, model string) (*http.Request, error) {
+	images, err := c.resolveImages(tempUserID, content.Images)
+	if err != nil {
+		return nil, err
+	}
+
+	juliusReq := map[string]interface{}{
+		"message": map[string]interface{}{
+			"content": content.Text,
+			"role":    "user",
+		},
+		"provider":         "default",
+		"chat_mode":        "auto",
+		"client_version":   "20240130",
+		"theme":            "dark",
+		"new_images":       juliusImagePayload(images),
+		"new_attachments":  nil,
+		"dataframe_format": "json",
+		"selectedModels": []string{
+			model,
+		},
+	}
+
+	reqBody, err := json.Marshal(juliusReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.BaseURL+"/api/chat/message", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.harPool != nil {
+		for name, values := range c.harPool.next() {
+			for _, v := range values {
+				req.Header.Add(name, v)
+			}
+		}
+	} else {
+		req.Header.Set("Platform", "web")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36")
+		req.Header.Set("interactive-charts", "true")
+		req.Header.Set("use-dict", "true")
+		req.Header.Set("Gcs", "true")
+		req.Header.Set("Is-Native", "false")
+		req.Header.Set("sec-ch-ua-platform", "Windows")
+		req.Header.Set("Accept", "*/*")
+		req.Header.Set("Sec-Fetch-Site", "same-site")
+		req.Header.Set("Sec-Fetch-Mode", "cors")
+		req.Header.Set("Sec-Fetch-Dest", "empty")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("is-demo", tempUserID)
+	req.Header.Set("conversation-id", conversationID)
+
+	return req, nil
+}
+
+func (c *JuliusClient) sendMessage(tempUserID, conversationID string, content Content, model string) (string, error) {
+	req, err := c.buildRequest(tempUserID, conversationID, content, model)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", ErrQuotaExhausted
+	}
+
+	var fullResponse strings.Builder
+	reader := bufio.NewReader(resp.Body)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		var jsonResp map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &jsonResp); err != nil {
+			continue
+		}
+		if content, ok := jsonResp["content"].(string); ok {
+			fullResponse.WriteString(content)
+		}
+	}
+	return fullResponse.String(), nil
+}
+
+// JuliusEvent is a single incremental fragment read off Julius's
+// newline-delimited JSON response stream. Err is set (with Content empty)
+// when reading the stream itself fails; the channel is closed right after.
+type JuliusEvent struct {
+	Content string
+	Err     error
+}
+
+// streamMessage opens the Julius chat request and relays each NDJSON line's
+// content field onto the returned channel as it arrives, instead of waiting
+// for the full response like sendMessage does.
+func (c *JuliusClient) streamMessage(tempUserID, conversationID string, content Content, model string) (<-chan JuliusEvent, error) {
+	req, err := c.buildRequest(tempUserID, conversationID, content, model)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		return nil, ErrQuotaExhausted
+	}
+
+	events := make(chan JuliusEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			var jsonResp map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &jsonResp); err != nil {
+				continue
+			}
+			if content, ok := jsonResp["content"].(string); ok && content != "" {
+				events <- JuliusEvent{Content: content}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			events <- JuliusEvent{Err: err}
+		}
+	}()
+
+	return events, nil
+}
@@ -1,14 +1,15 @@
 package handler
 
 import (
-	"bufio"
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -34,8 +35,58 @@ type OpenAIRequest struct {
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string  `json:"role"`
+	Content Content `json:"content"`
+}
+
+// Content holds a chat message's text plus any images attached through the
+// OpenAI vision-style content-parts array. It accepts either the plain
+// `"content": "..."` string form or `"content": [{"type":"text",...},
+// {"type":"image_url",...}]`, and always marshals back out as plain text
+// since outgoing (assistant) messages never carry images.
+type Content struct {
+	Text   string
+	Images []string
+}
+
+// contentPart is one element of the OpenAI vision-style content array.
+type contentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+func (c *Content) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		c.Text = s
+		return nil
+	}
+
+	var parts []contentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+
+	var text strings.Builder
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			text.WriteString(part.Text)
+		case "image_url":
+			if part.ImageURL != nil && part.ImageURL.URL != "" {
+				c.Images = append(c.Images, part.ImageURL.URL)
+			}
+		}
+	}
+	c.Text = text.String()
+	return nil
+}
+
+func (c Content) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Text)
 }
 
 type OpenAIResponse struct {
@@ -67,31 +118,90 @@ type ChatCompletionStreamResponse struct {
 	} `json:"choices"`
 }
 
+// mux is the package's single http.ServeMux, built once so new endpoints
+// (like /v1/embeddings down the line) just need another Handle call here.
+var mux = newMux()
+
+func newMux() *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/v1/chat/completions", withAuth(chatCompletionsHandler))
+	m.HandleFunc("/v1/models", withAuth(modelsHandler))
+	m.HandleFunc("/health", withAuth(healthHandler))
+	m.HandleFunc("/", withAuth(defaultHandler))
+	return m
+}
+
+// Handler is the shim's single entry point (e.g. for Vercel's Go runtime);
+// it just dispatches into mux.
 func Handler(w http.ResponseWriter, r *http.Request) {
-	authToken := os.Getenv("AUTH_TOKEN")
-	if authToken != "" {
-		requestToken := r.Header.Get("Authorization")
-		if requestToken == "" {
-			http.Error(w, "Access Denied", http.StatusUnauthorized)
-			return
-		}
-		requestToken = strings.TrimPrefix(requestToken, "Bearer ")
-		if requestToken != authToken {
-			http.Error(w, "Access Denied", http.StatusUnauthorized)
-			return
+	mux.ServeHTTP(w, r)
+}
+
+// withAuth enforces AUTH_TOKEN, when set, against the Authorization header
+// before handing off to next.
+func withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authToken := os.Getenv("AUTH_TOKEN")
+		if authToken != "" {
+			requestToken := r.Header.Get("Authorization")
+			if requestToken == "" {
+				http.Error(w, "Access Denied", http.StatusUnauthorized)
+				return
+			}
+			requestToken = strings.TrimPrefix(requestToken, "Bearer ")
+			if requestToken != authToken {
+				http.Error(w, "Access Denied", http.StatusUnauthorized)
+				return
+			}
 		}
+		next(w, r)
 	}
+}
 
-	if r.URL.Path != "/v1/chat/completions" {
-		w.Header().Set("Content-Type", "application/json")
-		response := map[string]string{
-			"status":  "Julius2Api Service Running...",
-			"message": "MoLoveSze...",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
+// defaultHandler is served for any path other than the routes registered
+// above, matching what this shim has always returned for an unrecognized
+// request.
+func defaultHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]string{
+		"status":  "Julius2Api Service Running...",
+		"message": "MoLoveSze...",
 	}
+	json.NewEncoder(w).Encode(response)
+}
 
+// healthHandler reports how many pre-warmed temp_user_id values the pool is
+// currently holding.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "ok",
+		"pool_depth": userPool.Depth(),
+	})
+}
+
+// modelsHandler serves the OpenAI-compatible GET /v1/models shape so client
+// model pickers can populate from modelMapping's keys.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	created := getCurrentTimestamp()
+	data := make([]map[string]interface{}, 0, len(modelMapping))
+	for id := range modelMapping {
+		data = append(data, map[string]interface{}{
+			"id":       id,
+			"object":   "model",
+			"created":  created,
+			"owned_by": "julius2api",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -109,103 +219,63 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		openAIReq.Model = "GPT-4o mini"
 	}
 
-	tempUserID, err := getTempUserID()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	juliusResp, err := sendToJulius(tempUserID, openAIReq.Messages[len(openAIReq.Messages)-1].Content, openAIReq.Model)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if len(openAIReq.Messages) == 0 {
+		http.Error(w, "messages must not be empty", http.StatusBadRequest)
 		return
 	}
 
-	isStream := openAIReq.Stream
-
-	respId := "chatcmpl-" + tempUserID
 	created := getCurrentTimestamp()
 
-	if isStream {
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		chunks := splitIntoChunks(juliusResp, 50)
-		firstResponse := ChatCompletionStreamResponse{
-			ID:      respId,
-			Object:  "chat.completion.chunk",
-			Created: created,
-			Model:   openAIReq.Model,
-			Choices: []struct {
-				Delta struct {
-					Content string `json:"content"`
-					Role    string `json:"role,omitempty"`
-				} `json:"delta"`
-				Index        int    `json:"index"`
-				FinishReason string `json:"finish_reason,omitempty"`
-			}{
-				{
-					Delta: struct {
-						Content string `json:"content"`
-						Role    string `json:"role,omitempty"`
-					}{
-						Role: "assistant",
-					},
-					Index: 0,
-				},
-			},
+	if openAIReq.Stream {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
 		}
 
-		data, err := json.Marshal(firstResponse)
+		conversationID, events, err := streamJulius(openAIReq.Messages, openAIReq.Model)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fmt.Fprintf(w, "data: %s\n\n", string(data))
-
-		for i, chunk := range chunks {
-			response := ChatCompletionStreamResponse{
-				ID:      respId,
-				Object:  "chat.completion.chunk",
-				Created: created,
-				Model:   openAIReq.Model,
-				Choices: []struct {
-					Delta struct {
-						Content string `json:"content"`
-						Role    string `json:"role,omitempty"`
-					} `json:"delta"`
-					Index        int    `json:"index"`
-					FinishReason string `json:"finish_reason,omitempty"`
-				}{
-					{
-						Delta: struct {
-							Content string `json:"content"`
-							Role    string `json:"role,omitempty"`
-						}{
-							Content: chunk,
-						},
-						Index: 0,
-						FinishReason: func() string {
-							if i == len(chunks)-1 {
-								return "stop"
-							}
-							return ""
-						}(),
-					},
-				},
-			}
+		respId := "chatcmpl-" + conversationID
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
 
-			data, err := json.Marshal(response)
+		writeChunk := func(chunk ChatCompletionStreamResponse) {
+			data, err := json.Marshal(chunk)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			fmt.Fprintf(w, "data: %s\n\n", string(data))
+			flusher.Flush()
 		}
 
+		writeChunk(newStreamChunk(respId, created, openAIReq.Model, "assistant", "", ""))
+
+		for ev := range events {
+			if ev.Err != nil {
+				break
+			}
+			if ev.Content == "" {
+				continue
+			}
+			writeChunk(newStreamChunk(respId, created, openAIReq.Model, "", ev.Content, ""))
+		}
+
+		writeChunk(newStreamChunk(respId, created, openAIReq.Model, "", "", "stop"))
 		fmt.Fprintf(w, "data: [DONE]\n\n")
+		flusher.Flush()
 	} else {
+		conversationID, juliusResp, err := sendToJulius(openAIReq.Messages, openAIReq.Model)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respId := "chatcmpl-" + conversationID
+
 		w.Header().Set("Content-Type", "application/json")
 		response := OpenAIResponse{
 			Id:      respId,
@@ -217,7 +287,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 					Index: 0,
 					Message: Message{
 						Role:    "assistant",
-						Content: juliusResp,
+						Content: Content{Text: juliusResp},
 					},
 					FinishReason: "stop",
 				},
@@ -227,106 +297,221 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func splitIntoChunks(text string, chunkSize int) []string {
-	var chunks []string
-	runes := []rune(text)
-	for i := 0; i < len(runes); i += chunkSize {
-		end := i + chunkSize
-		if end > len(runes) {
-			end = len(runes)
-		}
-		chunks = append(chunks, string(runes[i:end]))
+// newStreamChunk builds a single SSE chat.completion.chunk event. Role is set
+// only on the opening chunk, finishReason only on the closing one; every
+// chunk in between just carries a content delta.
+func newStreamChunk(respId string, created int64, model, role, content, finishReason string) ChatCompletionStreamResponse {
+	chunk := ChatCompletionStreamResponse{
+		ID:      respId,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   model,
+	}
+	chunk.Choices = []struct {
+		Delta struct {
+			Content string `json:"content"`
+			Role    string `json:"role,omitempty"`
+		} `json:"delta"`
+		Index        int    `json:"index"`
+		FinishReason string `json:"finish_reason,omitempty"`
+	}{
+		{
+			Delta: struct {
+				Content string `json:"content"`
+				Role    string `json:"role,omitempty"`
+			}{
+				Content: content,
+				Role:    role,
+			},
+			Index:        0,
+			FinishReason: finishReason,
+		},
 	}
-	return chunks
+	return chunk
 }
 
 func getTempUserID() (string, error) {
-	resp, err := http.Get("https://playground.julius.ai/api/temp_user_id")
-	if err != nil {
-		return "", err
+	return defaultJuliusClient.getTempUserID()
+}
+
+// conversationCache maps a hash of the messages preceding the latest turn to
+// the Julius conversation-id that already has that history loaded, together
+// with the temp_user_id that conversation was created under. Julius ties a
+// conversation to the is-demo identity that opened it, so once an entry is
+// cached its temp_user_id is carved out of userPool for the conversation's
+// exclusive use, rather than being re-acquired from the shared pool on every
+// turn (which could otherwise pair the conversation-id with a different
+// anonymous identity).
+// conversationCache entries expire after ttl, matching how userPool ages out
+// its own pooled ids; on expiry the pinned temp_user_id is returned to
+// userPool instead of left to leak.
+type conversationCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]conversationEntry
+}
+
+type conversationEntry struct {
+	conversationID string
+	tempUserID     string
+	expiresAt      time.Time
+}
+
+var convCache = &conversationCache{
+	ttl:     envDuration("JULIUS_CONVERSATION_TTL", 10*time.Minute),
+	entries: make(map[string]conversationEntry),
+}
+
+func (c *conversationCache) get(key string) (conversationEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return conversationEntry{}, false
 	}
-	defer resp.Body.Close()
+	if time.Now().After(e.expiresAt) {
+		delete(c.entries, key)
+		userPool.Release(e.tempUserID, false)
+		return conversationEntry{}, false
+	}
+	return e, true
+}
 
-	var result struct {
-		Status     string `json:"status"`
-		TempUserID string `json:"temp_user_id"`
+func (c *conversationCache) set(key, conversationID, tempUserID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+			userPool.Release(e.tempUserID, false)
+		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+	c.entries[key] = conversationEntry{
+		conversationID: conversationID,
+		tempUserID:     tempUserID,
+		expiresAt:      time.Now().Add(c.ttl),
 	}
-	return result.TempUserID, nil
-	//return "自定义ID", nil
 }
 
-func sendToJulius(tempUserID, message string, model string) (string, error) {
-	conversationID := uuid.New().String()
+// evict drops a conversation's cache entry, e.g. because Julius reported its
+// pinned temp_user_id as quota-exhausted. The temp_user_id is not returned to
+// userPool: like any other quota-exhausted id, it's simply never reused.
+func (c *conversationCache) evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
 
-	juliusReq := map[string]interface{}{
-		"message": map[string]interface{}{
-			"content": message,
-			"role":    "user",
-		},
-		"provider":         "default",
-		"chat_mode":        "auto",
-		"client_version":   "20240130",
-		"theme":            "dark",
-		"new_images":       nil,
-		"new_attachments":  nil,
-		"dataframe_format": "json",
-		"selectedModels": []string{
-			model,
-		},
+// hashHistory derives a stable cache key from the message history preceding
+// the current turn, so the same prior conversation always maps to the same
+// Julius conversation-id.
+func hashHistory(messages []Message) string {
+	h := sha256.New()
+	for _, m := range messages {
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Content.Text))
+		h.Write([]byte{0})
+		for _, img := range m.Content.Images {
+			h.Write([]byte(img))
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// acquireConversation resolves the conversation-id and its pinned
+// temp_user_id for the given message history, replaying any turns Julius
+// hasn't seen yet under a freshly acquired id on cache miss. The returned
+// temp_user_id belongs to the conversation cache entry for the life of the
+// conversation; callers must not release it back to userPool themselves.
+//
+// An empty history has nothing to hash into a meaningful key — every new
+// chat would otherwise collide on hashHistory(nil) and share one
+// conversation-id (and pinned temp_user_id) across unrelated callers — so it
+// always mints a fresh conversation and skips the cache entirely. With no
+// cache entry to pin it to, that temp_user_id (returned with an empty key) is
+// released back to userPool by the caller once the turn has been sent.
+func acquireConversation(history []Message, model string) (conversationID, tempUserID, key string, err error) {
+	if len(history) == 0 {
+		tempUserID, err = userPool.Acquire()
+		if err != nil {
+			return "", "", "", err
+		}
+		return uuid.New().String(), tempUserID, "", nil
+	}
+
+	key = hashHistory(history)
+	if entry, ok := convCache.get(key); ok {
+		return entry.conversationID, entry.tempUserID, key, nil
 	}
 
-	reqBody, err := json.Marshal(juliusReq)
+	tempUserID, err = userPool.Acquire()
 	if err != nil {
-		return "", err
+		return "", "", key, err
+	}
+
+	conversationID = uuid.New().String()
+	for _, m := range history {
+		if _, err := defaultJuliusClient.sendMessage(tempUserID, conversationID, m.Content, model); err != nil {
+			if !errors.Is(err, ErrQuotaExhausted) {
+				userPool.Release(tempUserID, false)
+			}
+			return "", "", key, fmt.Errorf("failed to replay conversation history: %w", err)
+		}
 	}
 
-	req, err := http.NewRequest("POST", "https://playground.julius.ai/api/chat/message", bytes.NewBuffer(reqBody))
+	convCache.set(key, conversationID, tempUserID)
+	return conversationID, tempUserID, key, nil
+}
+
+// sendToJulius replays any message history that hasn't been seen before under
+// a fresh conversation-id, then sends the latest turn on that conversation so
+// Julius keeps the full context server-side.
+func sendToJulius(messages []Message, model string) (conversationID, response string, err error) {
+	history := messages[:len(messages)-1]
+	last := messages[len(messages)-1]
+
+	conversationID, tempUserID, key, err := acquireConversation(history, model)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	response, err = defaultJuliusClient.sendMessage(tempUserID, conversationID, last.Content, model)
+	if key == "" {
+		userPool.Release(tempUserID, errors.Is(err, ErrQuotaExhausted))
 	}
-	req.Header.Set("is-demo", tempUserID)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Platform", "web")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36")
-	req.Header.Set("conversation-id", conversationID)
-	req.Header.Set("interactive-charts", "true")
-	req.Header.Set("use-dict", "true")
-	req.Header.Set("Gcs", "true")
-	req.Header.Set("Is-Native", "false")
-	req.Header.Set("sec-ch-ua-platform", "Windows")
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Sec-Fetch-Site", "same-site")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		if errors.Is(err, ErrQuotaExhausted) {
+			convCache.evict(key)
+		}
+		return "", "", err
 	}
-	defer resp.Body.Close()
+	return conversationID, response, nil
+}
 
-	var fullResponse strings.Builder
-	reader := bufio.NewReader(resp.Body)
+// streamJulius mirrors sendToJulius's history-replay logic, but streams the
+// final turn back as it arrives instead of buffering it.
+func streamJulius(messages []Message, model string) (conversationID string, events <-chan JuliusEvent, err error) {
+	history := messages[:len(messages)-1]
+	last := messages[len(messages)-1]
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", err
-		}
-		var jsonResp map[string]interface{}
-		if err := json.Unmarshal([]byte(line), &jsonResp); err != nil {
-			continue
-		}
-		if content, ok := jsonResp["content"].(string); ok {
-			fullResponse.WriteString(content)
+	conversationID, tempUserID, key, err := acquireConversation(history, model)
+	if err != nil {
+		return "", nil, err
+	}
+
+	events, err = defaultJuliusClient.streamMessage(tempUserID, conversationID, last.Content, model)
+	if key == "" {
+		userPool.Release(tempUserID, errors.Is(err, ErrQuotaExhausted))
+	}
+	if err != nil {
+		if errors.Is(err, ErrQuotaExhausted) {
+			convCache.evict(key)
 		}
+		return "", nil, err
 	}
-	return fullResponse.String(), nil
+	return conversationID, events, nil
 }
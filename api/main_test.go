@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHashHistoryEmptyIsConstant(t *testing.T) {
+	// Documents the known degenerate case: an empty history always hashes to
+	// the same key, regardless of who's asking. acquireConversation must not
+	// use this as a cache key directly (see TestAcquireConversationEmptyHistorySkipsCache).
+	if hashHistory(nil) != hashHistory([]Message{}) {
+		t.Fatalf("hashHistory(nil) should equal hashHistory of another empty history")
+	}
+}
+
+func TestAcquireConversationEmptyHistorySkipsCache(t *testing.T) {
+	origEntries := userPool.entries
+	userPool.entries = []tempUserEntry{
+		{id: "user-1", expiresAt: time.Now().Add(time.Minute)},
+		{id: "user-2", expiresAt: time.Now().Add(time.Minute)},
+	}
+	defer func() { userPool.entries = origEntries }()
+
+	origConv := convCache.entries
+	convCache.entries = make(map[string]conversationEntry)
+	defer func() { convCache.entries = origConv }()
+
+	convID1, userID1, key1, err := acquireConversation(nil, "GPT-4o mini")
+	if err != nil {
+		t.Fatalf("acquireConversation returned error: %v", err)
+	}
+	convID2, userID2, key2, err := acquireConversation(nil, "GPT-4o mini")
+	if err != nil {
+		t.Fatalf("acquireConversation returned error: %v", err)
+	}
+
+	if convID1 == convID2 {
+		t.Fatalf("two new-chat calls got the same conversation-id %q; empty history must not collide", convID1)
+	}
+	if userID1 == userID2 {
+		t.Fatalf("two new-chat calls got the same temp_user_id %q; empty history must not share a pinned identity", userID1)
+	}
+	if key1 != "" || key2 != "" {
+		t.Fatalf("empty history must not populate a conversationCache key, got %q and %q", key1, key2)
+	}
+	if len(convCache.entries) != 0 {
+		t.Fatalf("convCache should have no entries for empty-history conversations, got %d", len(convCache.entries))
+	}
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExhausted is returned (or wrapped) by the Julius client code when
+// upstream responds with 429, so callers know to evict the temp-user-id that
+// made the request instead of returning it to the pool.
+var ErrQuotaExhausted = errors.New("julius: quota exhausted for temp user id")
+
+// tempUserPool pre-warms temp_user_id values in the background so request
+// handling doesn't pay for a synchronous round-trip to
+// playground.julius.ai/api/temp_user_id on every call. Ids are handed out
+// with Acquire and must be returned with Release, which either recycles the
+// id or evicts it when Julius reported it as quota-exhausted.
+type tempUserPool struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries []tempUserEntry
+}
+
+type tempUserEntry struct {
+	id        string
+	expiresAt time.Time
+}
+
+// userPool is the process-wide pool used by Handler.
+var userPool = newTempUserPool()
+
+func newTempUserPool() *tempUserPool {
+	p := &tempUserPool{
+		size: envInt("JULIUS_POOL_SIZE", 5),
+		ttl:  envDuration("JULIUS_ID_TTL", 10*time.Minute),
+	}
+	go p.refillLoop()
+	return p
+}
+
+// Acquire hands out a pooled temp_user_id, minting one synchronously if the
+// pool is currently empty.
+func (p *tempUserPool) Acquire() (string, error) {
+	p.mu.Lock()
+	now := time.Now()
+	for len(p.entries) > 0 {
+		entry := p.entries[len(p.entries)-1]
+		p.entries = p.entries[:len(p.entries)-1]
+		if entry.expiresAt.After(now) {
+			p.mu.Unlock()
+			go p.refill()
+			return entry.id, nil
+		}
+	}
+	p.mu.Unlock()
+
+	id, err := getTempUserID()
+	if err != nil {
+		return "", err
+	}
+	go p.refill()
+	return id, nil
+}
+
+// Release returns an id to the pool, unless quotaExhausted is set, in which
+// case the id is dropped so it's never handed out again.
+func (p *tempUserPool) Release(id string, quotaExhausted bool) {
+	if quotaExhausted || id == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = append(p.entries, tempUserEntry{id: id, expiresAt: time.Now().Add(p.ttl)})
+}
+
+// Depth reports how many ready-to-use ids the pool is currently holding, for
+// the /health endpoint.
+func (p *tempUserPool) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// refill tops the pool back up to its configured size, dropping expired
+// entries along the way. It's safe to run concurrently with itself; at worst
+// the pool briefly overshoots size.
+func (p *tempUserPool) refill() {
+	p.mu.Lock()
+	now := time.Now()
+	live := p.entries[:0]
+	for _, e := range p.entries {
+		if e.expiresAt.After(now) {
+			live = append(live, e)
+		}
+	}
+	p.entries = live
+	missing := p.size - len(p.entries)
+	p.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		id, err := getTempUserID()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.entries = append(p.entries, tempUserEntry{id: id, expiresAt: time.Now().Add(p.ttl)})
+		p.mu.Unlock()
+	}
+}
+
+// refillLoop keeps the pool topped up in the background so Acquire rarely
+// has to mint an id synchronously.
+func (p *tempUserPool) refillLoop() {
+	p.refill()
+	ticker := time.NewTicker(p.ttl / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.refill()
+	}
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
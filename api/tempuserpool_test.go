@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTempUserPoolAcquireReusesReleasedID(t *testing.T) {
+	p := &tempUserPool{
+		size:    1,
+		ttl:     time.Minute,
+		entries: []tempUserEntry{{id: "id-a", expiresAt: time.Now().Add(time.Minute)}},
+	}
+
+	id, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire returned error: %v", err)
+	}
+	if id != "id-a" {
+		t.Fatalf("Acquire returned %q, want %q", id, "id-a")
+	}
+	if depth := p.Depth(); depth != 0 {
+		t.Fatalf("Depth after Acquire = %d, want 0", depth)
+	}
+
+	p.Release(id, false)
+	if depth := p.Depth(); depth != 1 {
+		t.Fatalf("Depth after Release = %d, want 1", depth)
+	}
+}
+
+func TestTempUserPoolReleaseQuotaExhaustedDrops(t *testing.T) {
+	p := &tempUserPool{size: 1, ttl: time.Minute}
+
+	p.Release("id-b", true)
+	if depth := p.Depth(); depth != 0 {
+		t.Fatalf("Depth after quota-exhausted Release = %d, want 0", depth)
+	}
+}